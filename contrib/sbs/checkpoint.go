@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RunState is the on-disk checkpoint written to --state-file. It's enough
+// to resume a killed run from where it left off, or to replay just the
+// queries that mismatched last time.
+type RunState struct {
+	RunID                 string   `json:"run_id"`
+	LogFile               string   `json:"log_file"`
+	LogSize               int64    `json:"log_size"`
+	FirstLineHash         string   `json:"first_line_hash"`
+	LogOffset             int64    `json:"log_offset"`
+	Total                 uint64   `json:"total"`
+	Failed                uint64   `json:"failed"`
+	MismatchedQueryHashes []string `json:"mismatched_query_hashes"`
+}
+
+// loadRunState reads a state file written by a previous run, if any.
+func loadRunState(path string) (*RunState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s RunState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, errors.Wrap(err, "while parsing state file")
+	}
+	return &s, nil
+}
+
+// save writes the state file atomically (write to a temp file in the same
+// directory, then rename) so a crash mid-write never leaves a truncated,
+// unusable checkpoint behind.
+func (s *RunState) save(path string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "while marshalling state")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return errors.Wrap(err, "while writing temp state file")
+	}
+	return os.Rename(tmp, path)
+}
+
+// fingerprintLogFile captures enough of a log file's identity (size + hash
+// of its first line) to tell whether a state file still refers to it.
+func fingerprintLogFile(f *os.File) (size int64, firstLineHash string, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, "", errors.Wrap(err, "while statting log file")
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, "", errors.Wrap(err, "while seeking to start of log file")
+	}
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, "", errors.Wrap(err, "while rewinding log file")
+	}
+	return info.Size(), queryHash(line), nil
+}
+
+// newRunID generates a short identifier for a fresh run.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// resolveRunState decides whether to resume a prior run or start a fresh
+// one: if statePath points at a state file for the same log file (same
+// size + first-line hash), its LogOffset tells the caller where to seek
+// to; otherwise a new RunState is returned with LogOffset 0.
+func resolveRunState(f *os.File, logPath, statePath string) (*RunState, error) {
+	size, firstLineHash, err := fingerprintLogFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if statePath != "" {
+		if prev, err := loadRunState(statePath); err == nil &&
+			prev.LogFile == logPath && prev.LogSize == size && prev.FirstLineHash == firstLineHash {
+			return prev, nil
+		}
+	}
+
+	return &RunState{
+		RunID:         newRunID(),
+		LogFile:       logPath,
+		LogSize:       size,
+		FirstLineHash: firstLineHash,
+	}, nil
+}
+
+// mismatchSet is a concurrency-safe accumulator of the query hashes that
+// have mismatched during a run, used both to populate the state file and
+// to drive --replay-only.
+type mismatchSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+func newMismatchSet(seed []string) *mismatchSet {
+	s := &mismatchSet{seen: make(map[string]struct{}, len(seed))}
+	for _, h := range seed {
+		s.seen[h] = struct{}{}
+	}
+	return s
+}
+
+func (s *mismatchSet) add(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[hash] = struct{}{}
+}
+
+func (s *mismatchSet) contains(hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.seen[hash]
+	return ok
+}
+
+func (s *mismatchSet) slice() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.seen))
+	for h := range s.seen {
+		out = append(out, h)
+	}
+	return out
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRunStateSaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	want := &RunState{
+		RunID:                 "abc123",
+		LogFile:               "/var/log/alpha.log",
+		LogSize:               1024,
+		FirstLineHash:         "deadbeef",
+		LogOffset:             512,
+		Total:                 10,
+		Failed:                2,
+		MismatchedQueryHashes: []string{"aaa", "bbb"},
+	}
+	if err := want.save(path); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+
+	got, err := loadRunState(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading state: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded state %+v does not match saved state %+v", got, want)
+	}
+}
+
+func TestResolveRunStateFreshLogFile(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "alpha.log")
+	if err := os.WriteFile(logPath, []byte("line one\nline two\n"), 0644); err != nil {
+		t.Fatalf("unexpected error writing log file: %v", err)
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening log file: %v", err)
+	}
+	defer f.Close()
+
+	state, err := resolveRunState(f, logPath, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.LogOffset != 0 {
+		t.Fatalf("expected a fresh run to start at offset 0, got %d", state.LogOffset)
+	}
+	if state.RunID == "" {
+		t.Fatalf("expected a fresh run to get a non-empty RunID")
+	}
+}
+
+func TestResolveRunStateResumesMatchingLogFile(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "alpha.log")
+	if err := os.WriteFile(logPath, []byte("line one\nline two\n"), 0644); err != nil {
+		t.Fatalf("unexpected error writing log file: %v", err)
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening log file: %v", err)
+	}
+	defer f.Close()
+
+	size, firstLineHash, err := fingerprintLogFile(f)
+	if err != nil {
+		t.Fatalf("unexpected error fingerprinting log file: %v", err)
+	}
+
+	statePath := filepath.Join(dir, "state.json")
+	prev := &RunState{
+		RunID:         "prev-run",
+		LogFile:       logPath,
+		LogSize:       size,
+		FirstLineHash: firstLineHash,
+		LogOffset:     9,
+	}
+	if err := prev.save(statePath); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+
+	state, err := resolveRunState(f, logPath, statePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.RunID != "prev-run" || state.LogOffset != 9 {
+		t.Fatalf("expected resolveRunState to resume the prior run, got %+v", state)
+	}
+}
+
+func TestResolveRunStateIgnoresStateForDifferentLogFile(t *testing.T) {
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "alpha.log")
+	if err := os.WriteFile(logPath, []byte("line one\nline two\n"), 0644); err != nil {
+		t.Fatalf("unexpected error writing log file: %v", err)
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatalf("unexpected error opening log file: %v", err)
+	}
+	defer f.Close()
+
+	statePath := filepath.Join(dir, "state.json")
+	prev := &RunState{
+		RunID:         "prev-run",
+		LogFile:       "/some/other.log",
+		LogSize:       999,
+		FirstLineHash: "not-the-real-hash",
+		LogOffset:     9,
+	}
+	if err := prev.save(statePath); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+
+	state, err := resolveRunState(f, logPath, statePath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state.RunID == "prev-run" || state.LogOffset != 0 {
+		t.Fatalf("expected a fresh run when the state file refers to a different log file, got %+v", state)
+	}
+}
+
+func TestMismatchSet(t *testing.T) {
+	s := newMismatchSet([]string{"seed"})
+	if !s.contains("seed") {
+		t.Fatalf("expected the seeded hash to be present")
+	}
+	if s.contains("other") {
+		t.Fatalf("expected an unseen hash not to be present")
+	}
+
+	s.add("other")
+	if !s.contains("other") {
+		t.Fatalf("expected an added hash to be present")
+	}
+
+	slice := s.slice()
+	if len(slice) != 2 {
+		t.Fatalf("expected 2 hashes in the slice, got %v", slice)
+	}
+}
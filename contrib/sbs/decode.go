@@ -0,0 +1,185 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/dgraph-io/dgo/v210/protos/api"
+	"github.com/pkg/errors"
+)
+
+// LogRecord is a single replayable unit decoded from one alpha log line,
+// wrapping the api.Request that should be sent to both clusters. Raw holds
+// the original log line verbatim, since standalone mutations carry no query
+// text of their own and Req.Query alone isn't enough to tell them apart.
+type LogRecord struct {
+	Req *api.Request
+	Raw string
+}
+
+// LogRecordDecoder turns one alpha log line into a LogRecord. Decoders
+// return an error when the line isn't theirs to handle, so processLog can
+// try the next one in line without having to know the log format up front.
+type LogRecordDecoder interface {
+	Decode(line string) (*LogRecord, error)
+}
+
+// decodersForMode returns the decoders that should be tried, in order, for
+// the given --mode.
+func decodersForMode(mode string) ([]LogRecordDecoder, error) {
+	switch mode {
+	case "", "query":
+		return []LogRecordDecoder{queryDecoder{}}, nil
+	case "mutation":
+		return []LogRecordDecoder{upsertDecoder{}, mutationDecoder{}}, nil
+	case "mixed":
+		return []LogRecordDecoder{queryDecoder{}, upsertDecoder{}, mutationDecoder{}}, nil
+	default:
+		return nil, errors.Errorf("unknown --mode %q, must be query, mutation or mixed", mode)
+	}
+}
+
+// decodeLine runs a line through the given decoders in order, returning the
+// first one that successfully matched.
+func decodeLine(decoders []LogRecordDecoder, line string) (*LogRecord, error) {
+	var lastErr error
+	for _, d := range decoders {
+		rec, err := d.Decode(line)
+		if err == nil {
+			return rec, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.Errorf("no decoder registered")
+	}
+	return nil, lastErr
+}
+
+// queryDecoder recognizes plain read-only "Got a query:" lines.
+type queryDecoder struct{}
+
+func (queryDecoder) Decode(s string) (*LogRecord, error) {
+	r, err := getReq(s)
+	if err != nil {
+		return nil, err
+	}
+	return &LogRecord{Req: r, Raw: s}, nil
+}
+
+var (
+	isMutation   = regexp.MustCompile(`Got a mutation: mutations:<(.*)> commit_now:(true|false)`)
+	isUpsert     = regexp.MustCompile(`Got an upsert: query:(.*) mutations:<(.*)> commit_now:(true|false)`)
+	setNquadsRe  = regexp.MustCompile(`set_nquads:"(.*?)"`)
+	delNquadsRe  = regexp.MustCompile(`del_nquads:"(.*?)"`)
+	setJSONRe    = regexp.MustCompile(`set_json:"(.*?)"`)
+	deleteJSONRe = regexp.MustCompile(`delete_json:"(.*?)"`)
+)
+
+// mutationDecoder recognizes standalone "Got a mutation:" lines carrying set
+// or delete nquads, or JSON mutations.
+type mutationDecoder struct{}
+
+func (mutationDecoder) Decode(s string) (*LogRecord, error) {
+	m := isMutation.FindStringSubmatch(s)
+	if len(m) == 0 {
+		return nil, errors.Errorf("not a mutation log line")
+	}
+	mu, err := decodeMutation(m[1])
+	if err != nil {
+		return nil, err
+	}
+	commitNow, err := strconv.ParseBool(m[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing commit_now")
+	}
+	return &LogRecord{Req: &api.Request{
+		Mutations: []*api.Mutation{mu},
+		CommitNow: commitNow,
+	}, Raw: s}, nil
+}
+
+// upsertDecoder recognizes "Got an upsert:" lines, which pair a query with
+// one or more mutations guarded by that query's result.
+type upsertDecoder struct{}
+
+func (upsertDecoder) Decode(s string) (*LogRecord, error) {
+	m := isUpsert.FindStringSubmatch(s)
+	if len(m) == 0 {
+		return nil, errors.Errorf("not an upsert log line")
+	}
+	qm := queryRe.FindStringSubmatch(m[1])
+	if len(qm) == 0 {
+		return nil, errors.Errorf("no valid query found in upsert block")
+	}
+	query, err := strconv.Unquote(qm[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "while unquoting upsert query")
+	}
+	mu, err := decodeMutation(m[2])
+	if err != nil {
+		return nil, err
+	}
+	commitNow, err := strconv.ParseBool(m[3])
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing commit_now")
+	}
+	return &LogRecord{Req: &api.Request{
+		Query:     query,
+		Mutations: []*api.Mutation{mu},
+		CommitNow: commitNow,
+	}, Raw: s}, nil
+}
+
+// decodeMutation pulls the nquad/JSON payloads out of the protobuf text
+// dump of a single api.Mutation.
+func decodeMutation(s string) (*api.Mutation, error) {
+	mu := &api.Mutation{}
+	if m := setNquadsRe.FindStringSubmatch(s); len(m) > 1 {
+		mu.SetNquads = []byte(m[1])
+	}
+	if m := delNquadsRe.FindStringSubmatch(s); len(m) > 1 {
+		mu.DelNquads = []byte(m[1])
+	}
+	if m := setJSONRe.FindStringSubmatch(s); len(m) > 1 {
+		mu.SetJson = []byte(m[1])
+	}
+	if m := deleteJSONRe.FindStringSubmatch(s); len(m) > 1 {
+		mu.DeleteJson = []byte(m[1])
+	}
+	if len(mu.SetNquads) == 0 && len(mu.DelNquads) == 0 && len(mu.SetJson) == 0 && len(mu.DeleteJson) == 0 {
+		return nil, errors.Errorf("mutation block had no recognizable payload")
+	}
+	return mu, nil
+}
+
+// uidKeyDiff reports blank-node keys that only one side produced a UID for.
+// The UID values themselves are expected to differ between clusters, so
+// only the key sets are comparable.
+func uidKeyDiff(left, right map[string]string) []DiffOp {
+	var ops []DiffOp
+	keys := make(map[string]struct{}, len(left)+len(right))
+	for k := range left {
+		keys[k] = struct{}{}
+	}
+	for k := range right {
+		keys[k] = struct{}{}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		_, lok := left[k]
+		_, rok := right[k]
+		switch {
+		case lok && !rok:
+			ops = append(ops, DiffOp{Type: "removed", Path: ".uids." + k, Left: left[k]})
+		case !lok && rok:
+			ops = append(ops, DiffOp{Type: "added", Path: ".uids." + k, Right: right[k]})
+		}
+	}
+	return ops
+}
@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestDecodeMutationSetNquads(t *testing.T) {
+	mu, err := decodeMutation(`set_nquads:"_:a <name> bob ."`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(mu.SetNquads) != `_:a <name> bob .` {
+		t.Fatalf("unexpected SetNquads: %q", mu.SetNquads)
+	}
+}
+
+func TestDecodeMutationNoPayload(t *testing.T) {
+	if _, err := decodeMutation(`commit_now:true`); err == nil {
+		t.Fatalf("expected an error for a mutation block with no recognizable payload")
+	}
+}
+
+func TestMutationDecoder(t *testing.T) {
+	line := `Got a mutation: mutations:<set_nquads:"_:a <name> bob ." > commit_now:true`
+	rec, err := (mutationDecoder{}).Decode(line)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Raw != line {
+		t.Fatalf("expected Raw to be the original line, got %q", rec.Raw)
+	}
+	if len(rec.Req.Mutations) != 1 || !rec.Req.CommitNow {
+		t.Fatalf("unexpected decoded request: %+v", rec.Req)
+	}
+}
+
+func TestUpsertDecoder(t *testing.T) {
+	line := `Got an upsert: query:"query { u as var(func: has(email)) }" ` +
+		`mutations:<set_nquads:"uid(u) <name> bob ." > commit_now:true`
+	rec, err := (upsertDecoder{}).Decode(line)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Req.Query == "" {
+		t.Fatalf("expected the upsert's query to be decoded, got empty string")
+	}
+	if len(rec.Req.Mutations) != 1 {
+		t.Fatalf("expected one mutation, got %+v", rec.Req.Mutations)
+	}
+}
+
+// TestDecodeLineRawDistinguishesMutations checks that, since standalone
+// mutations carry no query text, two different mutation lines still decode
+// to distinct Raw values so queryHash can tell them apart.
+func TestDecodeLineRawDistinguishesMutations(t *testing.T) {
+	decoders, err := decodersForMode("mutation")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	l1 := `Got a mutation: mutations:<set_nquads:"_:a <name> bob ." > commit_now:true`
+	l2 := `Got a mutation: mutations:<set_nquads:"_:a <name> alice ." > commit_now:true`
+
+	r1, err := decodeLine(decoders, l1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r2, err := decodeLine(decoders, l2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r1.Raw == r2.Raw {
+		t.Fatalf("expected distinct Raw values for distinct mutation lines")
+	}
+	if queryHash(r1.Raw) == queryHash(r2.Raw) {
+		t.Fatalf("expected distinct query hashes for distinct mutation lines")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+)
+
+// DiffOp describes a single point of divergence between the reference
+// cluster's JSON response and one other cluster's response for a query.
+type DiffOp struct {
+	Type  string      `json:"type"` // "added", "removed", "changed", "one-sided timeout", "one-sided error" or "two-sided error"
+	Path  string      `json:"path"`
+	Left  interface{} `json:"left,omitempty"`  // value on the reference cluster
+	Right interface{} `json:"right,omitempty"` // value on the compared cluster
+}
+
+// MismatchRecord is everything a reporter needs to describe one failed
+// comparison across N clusters. Diffs is keyed by the endpoint being
+// compared against the reference; Agreement groups endpoints by which of
+// them produced identical responses, which is what matters for spotting
+// quorum-level divergence across three-plus clusters.
+type MismatchRecord struct {
+	Query     string              `json:"query"`
+	Vars      map[string]string   `json:"vars,omitempty"`
+	Reference string              `json:"reference"`
+	Diffs     map[string][]DiffOp `json:"diffs"`
+	Agreement [][]string          `json:"agreement"`
+}
+
+// diffJSON parses the two JSON payloads and walks them in lockstep,
+// returning the list of paths where they diverge. A parse failure on either
+// side (e.g. an empty response from a query that errored) is itself
+// reported as a single top-level "changed" op carrying the raw payloads, so
+// callers always get at least one diagnostic entry instead of silently
+// losing the mismatch.
+func diffJSON(s1, s2 string) []DiffOp {
+	var o1, o2 interface{}
+	err1 := json.Unmarshal([]byte(s1), &o1)
+	err2 := json.Unmarshal([]byte(s2), &o2)
+	if err1 != nil || err2 != nil {
+		return []DiffOp{{Type: "changed", Path: "", Left: s1, Right: s2}}
+	}
+
+	var ops []DiffOp
+	walkDiff("", o1, o2, &ops)
+	return ops
+}
+
+func walkDiff(path string, left, right interface{}, ops *[]DiffOp) {
+	switch l := left.(type) {
+	case map[string]interface{}:
+		r, ok := right.(map[string]interface{})
+		if !ok {
+			*ops = append(*ops, DiffOp{Type: "changed", Path: path, Left: left, Right: right})
+			return
+		}
+		keys := make(map[string]struct{}, len(l)+len(r))
+		for k := range l {
+			keys[k] = struct{}{}
+		}
+		for k := range r {
+			keys[k] = struct{}{}
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			lv, lok := l[k]
+			rv, rok := r[k]
+			childPath := path + "." + k
+			switch {
+			case !lok:
+				*ops = append(*ops, DiffOp{Type: "added", Path: childPath, Right: rv})
+			case !rok:
+				*ops = append(*ops, DiffOp{Type: "removed", Path: childPath, Left: lv})
+			default:
+				walkDiff(childPath, lv, rv, ops)
+			}
+		}
+	case []interface{}:
+		r, ok := right.([]interface{})
+		if !ok {
+			*ops = append(*ops, DiffOp{Type: "changed", Path: path, Left: left, Right: right})
+			return
+		}
+		n := len(l)
+		if len(r) > n {
+			n = len(r)
+		}
+		for i := 0; i < n; i++ {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(l):
+				*ops = append(*ops, DiffOp{Type: "added", Path: childPath, Right: r[i]})
+			case i >= len(r):
+				*ops = append(*ops, DiffOp{Type: "removed", Path: childPath, Left: l[i]})
+			default:
+				walkDiff(childPath, l[i], r[i], ops)
+			}
+		}
+	default:
+		if !reflectEqual(left, right) {
+			*ops = append(*ops, DiffOp{Type: "changed", Path: path, Left: left, Right: right})
+		}
+	}
+}
+
+// reflectEqual compares two decoded JSON scalars/nils for equality.
+func reflectEqual(a, b interface{}) bool {
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+	return string(aj) == string(bj)
+}
+
+// DiffReporter consumes mismatch records as they're found and produces the
+// final report once the run is done.
+type DiffReporter interface {
+	Report(rec *MismatchRecord)
+	Close() error
+}
+
+// newDiffReporter builds the reporter configured by --diff-format and
+// --diff-output.
+func newDiffReporter(format, outPath string) (DiffReporter, error) {
+	var w io.WriteCloser = os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while creating diff output file %s", outPath)
+		}
+		w = f
+	}
+
+	switch format {
+	case "", "text":
+		return &textReporter{w: w}, nil
+	case "json":
+		return &jsonReporter{w: w}, nil
+	case "ndjson":
+		return &ndjsonReporter{w: w}, nil
+	default:
+		return nil, errors.Errorf("unknown --diff-format %q, must be text, json or ndjson", format)
+	}
+}
+
+// groupByAgreement buckets endpoints by the canonical form of the response
+// they returned, so a three-plus-way comparison can show which subset of
+// clusters agreed rather than just that the reference disagreed with one
+// of them.
+func groupByAgreement(endpoints []string, canonical map[string]string) [][]string {
+	groups := make(map[string][]string)
+	var order []string
+	for _, ep := range endpoints {
+		key := canonical[ep]
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], ep)
+	}
+	out := make([][]string, 0, len(order))
+	for _, key := range order {
+		out = append(out, groups[key])
+	}
+	return out
+}
+
+// canonicalJSON re-marshals a JSON payload with sorted object keys so two
+// responses that differ only in key order compare equal.
+func canonicalJSON(s string) string {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+type textReporter struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+func (t *textReporter) Report(rec *MismatchRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, "Failed Query: %s\nVars: %v\nReference: %s\nAgreement: %v\n",
+		rec.Query, rec.Vars, rec.Reference, rec.Agreement)
+	for endpoint, ops := range rec.Diffs {
+		for _, op := range ops {
+			fmt.Fprintf(t.w, "  [%s] %s %s: reference=%v other=%v\n",
+				endpoint, op.Type, op.Path, op.Left, op.Right)
+		}
+	}
+}
+
+func (t *textReporter) Close() error {
+	if t.w == os.Stdout {
+		return nil
+	}
+	return t.w.Close()
+}
+
+// jsonReporter buffers every record and writes a single JSON array on Close.
+type jsonReporter struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	records []*MismatchRecord
+}
+
+func (j *jsonReporter) Report(rec *MismatchRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.records = append(j.records, rec)
+}
+
+func (j *jsonReporter) Close() error {
+	enc := json.NewEncoder(j.w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(j.records); err != nil {
+		return errors.Wrap(err, "while writing json diff report")
+	}
+	if j.w == os.Stdout {
+		return nil
+	}
+	return j.w.Close()
+}
+
+// ndjsonReporter writes one JSON object per line as records arrive, so the
+// report can be tailed or post-processed while the run is still going.
+type ndjsonReporter struct {
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func (n *ndjsonReporter) Report(rec *MismatchRecord) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.enc == nil {
+		n.enc = json.NewEncoder(n.w)
+	}
+	if err := n.enc.Encode(rec); err != nil {
+		klog.Errorf("while writing ndjson diff record: %v", err)
+	}
+}
+
+func (n *ndjsonReporter) Close() error {
+	if n.w == os.Stdout {
+		return nil
+	}
+	return n.w.Close()
+}
+
+// diffSummary accumulates the aggregate stats printed at the end of a run:
+// per-predicate mismatch counts and the query shapes that diverge most.
+type diffSummary struct {
+	mu             sync.Mutex
+	predicateCount map[string]int
+	queryCount     map[string]int
+}
+
+func newDiffSummary() *diffSummary {
+	return &diffSummary{
+		predicateCount: make(map[string]int),
+		queryCount:     make(map[string]int),
+	}
+}
+
+func (s *diffSummary) add(query string, ops []DiffOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queryCount[querySignature(query)]++
+	for _, op := range ops {
+		s.predicateCount[topLevelPredicate(op.Path)]++
+	}
+}
+
+// topLevelPredicate reduces a diff path like ".q[0].name" down to the
+// top-level predicate/alias it falls under ("q.name"), which is what query
+// authors actually care about when triaging.
+func topLevelPredicate(path string) string {
+	// Drop array indices so every element of a list counts toward the same
+	// predicate.
+	var b []byte
+	inIndex := false
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '[':
+			inIndex = true
+		case c == ']':
+			inIndex = false
+		case !inIndex:
+			b = append(b, c)
+		}
+	}
+	path = string(b)
+
+	depth := 0
+	for i := 1; i < len(path); i++ {
+		if path[i] == '.' {
+			depth++
+			if depth == 2 {
+				return path[1:i]
+			}
+		}
+	}
+	if len(path) > 1 {
+		return path[1:]
+	}
+	return path
+}
+
+// querySignature collapses whitespace so structurally identical queries with
+// different formatting still group together in the summary.
+func querySignature(q string) string {
+	var b []byte
+	prevSpace := false
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+			if !prevSpace {
+				b = append(b, ' ')
+			}
+			prevSpace = true
+			continue
+		}
+		prevSpace = false
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+type countEntry struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+func topEntries(m map[string]int, n int) []countEntry {
+	entries := make([]countEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, countEntry{Key: k, Count: v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+func (s *diffSummary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	klog.Infof("--- Mismatch summary ---")
+	klog.Infof("Per-predicate mismatch counts:")
+	for _, e := range topEntries(s.predicateCount, 20) {
+		klog.Infof("  %-40s %d", e.Key, e.Count)
+	}
+	klog.Infof("Top diverging query shapes:")
+	for _, e := range topEntries(s.queryCount, 10) {
+		klog.Infof("  %-80s %d", e.Key, e.Count)
+	}
+}
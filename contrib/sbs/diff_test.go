@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestDiffJSONIdentical(t *testing.T) {
+	ops := diffJSON(`{"q":[{"name":"a"}]}`, `{"q":[{"name":"a"}]}`)
+	if len(ops) != 0 {
+		t.Fatalf("expected no diff ops for identical payloads, got %+v", ops)
+	}
+}
+
+func TestDiffJSONChangedValue(t *testing.T) {
+	ops := diffJSON(`{"q":[{"name":"a"}]}`, `{"q":[{"name":"b"}]}`)
+	if len(ops) != 1 {
+		t.Fatalf("expected exactly one diff op, got %+v", ops)
+	}
+	if ops[0].Type != "changed" || ops[0].Path != ".q[0].name" {
+		t.Fatalf("unexpected diff op: %+v", ops[0])
+	}
+}
+
+func TestDiffJSONAddedRemovedKeys(t *testing.T) {
+	ops := diffJSON(`{"a":1}`, `{"b":2}`)
+	types := map[string]bool{}
+	for _, op := range ops {
+		types[op.Type] = true
+	}
+	if !types["added"] || !types["removed"] {
+		t.Fatalf("expected both an added and a removed op, got %+v", ops)
+	}
+}
+
+// TestDiffJSONUnparseable exercises one side not being valid JSON at all
+// (e.g. an empty body from a query that errored): diffJSON must still
+// surface a diagnostic op instead of silently reporting no diff.
+func TestDiffJSONUnparseable(t *testing.T) {
+	ops := diffJSON("1", "")
+	if len(ops) != 1 {
+		t.Fatalf("expected one diagnostic op for unparseable payload, got %+v", ops)
+	}
+	if ops[0].Type != "changed" || ops[0].Left != "1" || ops[0].Right != "" {
+		t.Fatalf("unexpected diagnostic op: %+v", ops[0])
+	}
+}
+
+func TestUidKeyDiff(t *testing.T) {
+	left := map[string]string{"a": "0x1", "b": "0x2"}
+	right := map[string]string{"a": "0x9", "c": "0x3"}
+
+	ops := uidKeyDiff(left, right)
+	if len(ops) != 2 {
+		t.Fatalf("expected 2 ops, got %+v", ops)
+	}
+
+	var sawRemovedB, sawAddedC bool
+	for _, op := range ops {
+		switch {
+		case op.Type == "removed" && op.Path == ".uids.b":
+			sawRemovedB = true
+		case op.Type == "added" && op.Path == ".uids.c":
+			sawAddedC = true
+		}
+	}
+	if !sawRemovedB || !sawAddedC {
+		t.Fatalf("expected removed .uids.b and added .uids.c, got %+v", ops)
+	}
+}
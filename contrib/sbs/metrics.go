@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+var (
+	queriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sbs_queries_total",
+		Help: "Total number of log records replayed against all clusters.",
+	})
+	queriesFailedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "sbs_queries_failed_total",
+		Help: "Total number of log records where at least one cluster diverged from the reference.",
+	})
+	queryDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sbs_query_duration_seconds",
+		Help:    "Latency of replaying a single request against one cluster.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	queueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sbs_queue_depth",
+		Help: "Number of decoded requests buffered waiting for a free worker.",
+	})
+	workersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "sbs_workers_busy",
+		Help: "Number of workers currently replaying a request.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queriesTotal, queriesFailedTotal, queryDurationSeconds,
+		queueDepth, workersBusy)
+}
+
+// startMetricsServer exposes the counters/histograms above on --metrics-addr
+// in the background; it never blocks the caller.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			klog.Errorf("While serving metrics on %s: %v", addr, err)
+		}
+	}()
+}
+
+// queryHash gives each distinct query a short, stable identifier so
+// structured logs and summaries can be grepped/joined without embedding the
+// full query text on every line.
+func queryHash(query string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(query))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestQueryHashDeterministic(t *testing.T) {
+	a := queryHash("query { me(func: uid(1)) { name } }")
+	b := queryHash("query { me(func: uid(1)) { name } }")
+	if a != b {
+		t.Fatalf("expected queryHash to be deterministic, got %q and %q", a, b)
+	}
+}
+
+func TestQueryHashDistinguishesInput(t *testing.T) {
+	a := queryHash("query one")
+	b := queryHash("query two")
+	if a == b {
+		t.Fatalf("expected distinct inputs to hash differently, both got %q", a)
+	}
+}
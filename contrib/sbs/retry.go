@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryableCodes are the gRPC codes worth backing off and retrying on; all
+// others (e.g. InvalidArgument) are terminal and retrying would just waste
+// a worker slot.
+var retryableCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.DeadlineExceeded:  true,
+	codes.ResourceExhausted: true,
+}
+
+func isRetryable(err error) bool {
+	st, ok := status.FromError(errors.Cause(err))
+	return ok && retryableCodes[st.Code()]
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	cause := errors.Cause(err)
+	if cause == context.DeadlineExceeded {
+		return true
+	}
+	st, ok := status.FromError(cause)
+	return ok && st.Code() == codes.DeadlineExceeded
+}
+
+// oneSidedDiffType labels a DiffOp produced when exactly one cluster errored
+// and the other didn't: timeouts get their own category since they're
+// usually transient load/slowness, anything else (terminal gRPC errors,
+// retries exhausted) is a generic one-sided error.
+func oneSidedDiffType(err error) string {
+	if isTimeout(err) {
+		return "one-sided timeout"
+	}
+	return "one-sided error"
+}
+
+// withRetry calls fn until it succeeds, ctx is done, the error isn't
+// retryable, or maxRetries retries (maxRetries+1 calls in all) have been
+// made, backing off exponentially with jitter between attempts.
+func withRetry(ctx context.Context, maxRetries int, backoff time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || ctx.Err() != nil || !isRetryable(err) || attempt >= maxRetries {
+			return err
+		}
+
+		wait := backoff * time.Duration(int64(1)<<uint(attempt))
+		wait += time.Duration(rand.Int63n(int64(backoff) + 1)) // jitter
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unavailable", status.Error(codes.Unavailable, "down"), true},
+		{"deadline exceeded", status.Error(codes.DeadlineExceeded, "slow"), true},
+		{"resource exhausted", status.Error(codes.ResourceExhausted, "busy"), true},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad"), false},
+		{"non-grpc error", errors.New("boom"), false},
+		{"wrapped retryable", errors.Wrap(status.Error(codes.Unavailable, "down"), "while calling"), true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isRetryable(c.err); got != c.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	if !isTimeout(context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded to be a timeout")
+	}
+	if !isTimeout(status.Error(codes.DeadlineExceeded, "slow")) {
+		t.Errorf("expected a DeadlineExceeded status to be a timeout")
+	}
+	if isTimeout(status.Error(codes.Unavailable, "down")) {
+		t.Errorf("expected an Unavailable status not to be a timeout")
+	}
+	if isTimeout(nil) {
+		t.Errorf("expected a nil error not to be a timeout")
+	}
+}
+
+func TestOneSidedDiffType(t *testing.T) {
+	if got := oneSidedDiffType(context.DeadlineExceeded); got != "one-sided timeout" {
+		t.Errorf("oneSidedDiffType(DeadlineExceeded) = %q, want %q", got, "one-sided timeout")
+	}
+	if got := oneSidedDiffType(status.Error(codes.Unavailable, "down")); got != "one-sided error" {
+		t.Errorf("oneSidedDiffType(Unavailable) = %q, want %q", got, "one-sided error")
+	}
+}
+
+func TestWithRetryRetriesUntilSuccess(t *testing.T) {
+	attempts := 0
+	err := withRetry(context.Background(), 3, time.Millisecond, func() error {
+		attempts++
+		if attempts < 3 {
+			return status.Error(codes.Unavailable, "down")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestWithRetryGivesUpOnTerminalError(t *testing.T) {
+	attempts := 0
+	wantErr := status.Error(codes.InvalidArgument, "bad")
+	err := withRetry(context.Background(), 3, time.Millisecond, func() error {
+		attempts++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("expected the terminal error to be returned unchanged, got %v", err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected exactly 1 attempt for a non-retryable error, got %d", attempts)
+	}
+}
+
+func TestWithRetryStopsAtMaxRetries(t *testing.T) {
+	attempts := 0
+	err := withRetry(context.Background(), 2, time.Millisecond, func() error {
+		attempts++
+		return status.Error(codes.Unavailable, "down")
+	})
+	if err == nil {
+		t.Fatalf("expected an error once retries are exhausted")
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 1 initial attempt + 2 retries = 3 calls, got %d", attempts)
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"reflect"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dgraph-io/dgo/v210"
@@ -49,11 +51,19 @@ type Command struct {
 }
 
 type Options struct {
-	logPath    string
-	alphaLeft  string
-	alphaRight string
-	countOnly  bool
-	numGo      int
+	logPath      string
+	alphas       []string
+	countOnly    bool
+	numGo        int
+	diffFormat   string
+	diffOutput   string
+	mode         string
+	metricsAddr  string
+	stateFile    string
+	replayOnly   bool
+	queryTimeout time.Duration
+	maxRetries   int
+	retryBackoff time.Duration
 }
 
 func init() {
@@ -66,14 +76,31 @@ func init() {
 	flags := Sbs.Cmd.Flags()
 	flags.StringVar(&opts.logPath,
 		"log-file", "", "Path of the alpha log file to replay")
-	flags.StringVar(&opts.alphaLeft,
-		"alpha-left", "", "GRPC endpoint of left alpha")
-	flags.StringVar(&opts.alphaRight,
-		"alpha-right", "", "GRPC endpoint of right alpha")
+	flags.StringArrayVar(&opts.alphas,
+		"alpha", nil, "GRPC endpoint of an alpha to compare (repeatable); "+
+			"the first one given is the reference cluster")
 	flags.BoolVar(&opts.countOnly,
-		"counts-only", false, "Only get the count of all predicates in the left alpha")
+		"counts-only", false, "Only get the count of all predicates in the reference alpha")
 	flags.IntVar(&opts.numGo,
 		"workers", 16, "Number of query request workers")
+	flags.StringVar(&opts.diffFormat,
+		"diff-format", "text", "Format of the mismatch report: text, json or ndjson")
+	flags.StringVar(&opts.diffOutput,
+		"diff-output", "", "File to write the mismatch report to (defaults to stdout)")
+	flags.StringVar(&opts.mode,
+		"mode", "query", "What kind of log lines to replay: query, mutation or mixed")
+	flags.StringVar(&opts.metricsAddr,
+		"metrics-addr", "", "If set, serve Prometheus metrics on this address (e.g. :2021)")
+	flags.StringVar(&opts.stateFile,
+		"state-file", "", "Path of a checkpoint file to resume a killed run from, and to update as this run progresses")
+	flags.BoolVar(&opts.replayOnly,
+		"replay-only", false, "Instead of replaying the whole log, only re-run the queries --state-file recorded as mismatched")
+	flags.DurationVar(&opts.queryTimeout,
+		"query-timeout", 1800*time.Second, "Per-attempt timeout for replaying a single request")
+	flags.IntVar(&opts.maxRetries,
+		"max-retries", 3, "Max number of retries for a request that fails with a retryable gRPC error")
+	flags.DurationVar(&opts.retryBackoff,
+		"retry-backoff", 500*time.Millisecond, "Base backoff duration between retries (doubles each attempt, plus jitter)")
 	Sbs.Conf = viper.New()
 	Sbs.Conf.BindPFlags(flags)
 
@@ -89,90 +116,264 @@ func main() {
 }
 
 func run(cmd *cobra.Command, args []string) error {
-	conn, err := grpc.Dial(opts.alphaLeft, grpc.WithInsecure())
-	if err != nil {
-		klog.Fatalf("While dialing grpc: %v\n", err)
+	if len(opts.alphas) == 0 {
+		klog.Fatalf("At least one --alpha endpoint is required\n")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	clients := make([]*dgo.Dgraph, len(opts.alphas))
+	for i, addr := range opts.alphas {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			klog.Fatalf("While dialing grpc %s: %v\n", addr, err)
+		}
+		defer conn.Close()
+		clients[i] = dgo.NewDgraphClient(api.NewDgraphClient(conn))
 	}
-	defer conn.Close()
-	dcLeft := dgo.NewDgraphClient(api.NewDgraphClient(conn))
 
 	if opts.countOnly {
-		getCounts(dcLeft)
+		getCounts(ctx, clients[0])
 		return nil
 	}
 
-	conn2, err := grpc.Dial(opts.alphaRight, grpc.WithInsecure())
-	if err != nil {
-		klog.Fatalf("While dialing grpc: %v\n", err)
+	if opts.metricsAddr != "" {
+		startMetricsServer(opts.metricsAddr)
 	}
-	defer conn2.Close()
-	dcRight := dgo.NewDgraphClient(api.NewDgraphClient(conn2))
 
-	processLog(dcLeft, dcRight)
+	processLog(ctx, clients, opts.alphas)
 	return nil
 }
 
-func processLog(dcLeft, dcRight *dgo.Dgraph) {
+func processLog(ctx context.Context, clients []*dgo.Dgraph, endpoints []string) {
 	f, err := os.Open(opts.logPath)
 	if err != nil {
 		klog.Fatalf("While opening log file got error: %v", err)
 	}
 	defer f.Close()
 
+	reporter, err := newDiffReporter(opts.diffFormat, opts.diffOutput)
+	if err != nil {
+		klog.Fatalf("While setting up diff reporter: %v", err)
+	}
+	summary := newDiffSummary()
+
+	decoders, err := decodersForMode(opts.mode)
+	if err != nil {
+		klog.Fatalf("While setting up log decoders: %v", err)
+	}
+
+	reference := endpoints[0]
+
+	state, err := resolveRunState(f, opts.logPath, opts.stateFile)
+	if err != nil {
+		klog.Fatalf("While resolving run state: %v", err)
+	}
+	mismatches := newMismatchSet(state.MismatchedQueryHashes)
+
+	if opts.replayOnly && opts.stateFile == "" {
+		klog.Fatalf("--replay-only requires --state-file to know which queries mismatched")
+	}
+	if !opts.replayOnly && state.LogOffset > 0 {
+		klog.Infof("Resuming run %s from byte offset %d (total=%d failed=%d)",
+			state.RunID, state.LogOffset, state.Total, state.Failed)
+		if _, err := f.Seek(state.LogOffset, io.SeekStart); err != nil {
+			klog.Fatalf("While seeking to checkpointed offset: %v", err)
+		}
+	}
+
 	var failed, total uint64
-	reqCh := make(chan *api.Request, opts.numGo*5)
+	if !opts.replayOnly {
+		failed, total = state.Failed, state.Total
+	}
+	var offset int64
+	if !opts.replayOnly {
+		offset = state.LogOffset
+	}
+	// reqCh carries plain queries, replayed concurrently across opts.numGo
+	// workers since they're read-only and order doesn't matter. mutCh carries
+	// everything that writes (standalone mutations and upserts), replayed by
+	// a single serial worker so they're applied to each cluster in the same
+	// order the alpha originally committed them in. In --mode=mixed a query
+	// can depend on data a preceding mutation just wrote, so there's no safe
+	// way to split queries onto the concurrent pool without risking a replay
+	// race that looks like a cluster mismatch; everything goes through mutCh
+	// there instead, and reqCh/the worker pool sit unused.
+	reqCh := make(chan *LogRecord, opts.numGo*5)
+	mutCh := make(chan *LogRecord, 5)
+	serialOnly := opts.mode == "mixed"
 
-	var wg sync.WaitGroup
-	worker := func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		for r := range reqCh {
-			respL, err := runQuery(r, dcLeft)
-			if err != nil {
-				klog.Errorf("While running on left: %v", err)
+	processRecord := func(workerID int, rec *LogRecord) {
+		r := rec.Req
+		workersBusy.Inc()
+		start := time.Now()
+
+		results := make([]*RequestResult, len(clients))
+		errs := make([]error, len(clients))
+		latencies := make([]time.Duration, len(clients))
+		var fanWg sync.WaitGroup
+		for i := range clients {
+			fanWg.Add(1)
+			go func(i int) {
+				defer fanWg.Done()
+				qStart := time.Now()
+				res, err := runRequest(ctx, r, clients[i])
+				latencies[i] = time.Since(qStart)
+				queryDurationSeconds.WithLabelValues(endpoints[i]).Observe(latencies[i].Seconds())
+				if err != nil {
+					klog.Errorf("While running on %s: %v", endpoints[i], err)
+				}
+				results[i], errs[i] = res, err
+			}(i)
+		}
+		fanWg.Wait()
+
+		diffs := make(map[string][]DiffOp)
+		var allDiffs []DiffOp
+		canonical := make(map[string]string, len(endpoints))
+		for i, ep := range endpoints {
+			canonical[ep] = canonicalJSON(results[i].Json)
+			if i == 0 {
+				continue
 			}
-			respR, err := runQuery(r, dcRight)
-			if err != nil {
-				klog.Errorf("While running on right: %v", err)
+
+			var ops []DiffOp
+			switch {
+			case errs[0] != nil && errs[i] != nil:
+				// Both sides errored (e.g. both hit DeadlineExceeded under load).
+				// Neither Json is meaningful here, so diffJSON would just compare
+				// two empty strings and wrongly report them as "changed".
+				ops = []DiffOp{{Type: "two-sided error", Path: "", Left: errs[0].Error(), Right: errs[i].Error()}}
+			case errs[i] != nil:
+				ops = []DiffOp{{Type: oneSidedDiffType(errs[i]), Path: "", Right: errs[i].Error()}}
+			case errs[0] != nil:
+				ops = []DiffOp{{Type: oneSidedDiffType(errs[0]), Path: "", Left: errs[0].Error()}}
+			default:
+				ops = diffJSON(results[0].Json, results[i].Json)
+				ops = append(ops, uidKeyDiff(results[0].Uids, results[i].Uids)...)
 			}
-			if !areEqualJSON(respL, respR) {
-				atomic.AddUint64(&failed, 1)
-				klog.Infof("Failed Query: %s \nVars: %v\nLeft: %v\nRight: %v\n",
-					r.Query, r.Vars, respL, respR)
+			if len(ops) > 0 {
+				diffs[ep] = ops
+				allDiffs = append(allDiffs, ops...)
 			}
-			atomic.AddUint64(&total, 1)
+		}
+
+		queriesTotal.Inc()
+		atomic.AddUint64(&total, 1)
+		if len(diffs) > 0 {
+			queriesFailedTotal.Inc()
+			atomic.AddUint64(&failed, 1)
+			mismatches.add(queryHash(rec.Raw))
+			reporter.Report(&MismatchRecord{
+				Query:     r.Query,
+				Vars:      r.Vars,
+				Reference: reference,
+				Diffs:     diffs,
+				Agreement: groupByAgreement(endpoints, canonical),
+			})
+			summary.add(r.Query, allDiffs)
+			klog.InfoS("query mismatch",
+				"queryHash", queryHash(rec.Raw),
+				"workerID", workerID,
+				"elapsed", time.Since(start),
+				"latencies", latencies,
+				"reference", reference,
+				"diverged", len(diffs))
+		}
+		workersBusy.Dec()
+	}
+
+	var wg sync.WaitGroup
+	worker := func(workerID int, wg *sync.WaitGroup) {
+		defer wg.Done()
+		for rec := range reqCh {
+			processRecord(workerID, rec)
 		}
 	}
 
 	for i := 0; i < opts.numGo; i++ {
 		wg.Add(1)
-		go worker(&wg)
+		go worker(i, &wg)
 	}
 
+	wg.Add(1)
 	go func() {
-		scan := bufio.NewScanner(f)
-		for scan.Scan() {
-			r, err := getReq(scan.Text())
+		defer wg.Done()
+		for rec := range mutCh {
+			processRecord(-1, rec)
+		}
+	}()
+
+	go func() {
+		reader := bufio.NewReader(f)
+		for {
+			line, err := reader.ReadString('\n')
+			if len(line) > 0 {
+				atomic.AddInt64(&offset, int64(len(line)))
+				rec, decErr := decodeLine(decoders, line)
+				if decErr == nil {
+					hash := queryHash(rec.Raw)
+					if !opts.replayOnly || mismatches.contains(hash) {
+						if serialOnly || len(rec.Req.Mutations) > 0 {
+							mutCh <- rec
+						} else {
+							reqCh <- rec
+						}
+						queueDepth.Set(float64(len(reqCh) + len(mutCh)))
+					}
+				}
+				// lines that no decoder recognizes are skipped
+			}
 			if err != nil {
-				// skipping the log line which doesn't have a valid query
-				continue
+				break
 			}
-			reqCh <- r
 		}
 		close(reqCh)
+		close(mutCh)
 	}()
 
+	saveState := func() {
+		if opts.stateFile == "" || opts.replayOnly {
+			return
+		}
+		state.LogOffset = atomic.LoadInt64(&offset)
+		state.Total = atomic.LoadUint64(&total)
+		state.Failed = atomic.LoadUint64(&failed)
+		state.MismatchedQueryHashes = mismatches.slice()
+		if err := state.save(opts.stateFile); err != nil {
+			klog.Errorf("While saving checkpoint: %v", err)
+		}
+	}
+
+	stopTicker := make(chan struct{})
+	tickerDone := make(chan struct{})
 	go func() {
+		defer close(tickerDone)
 		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				klog.Infof("Total: %d Failed: %d ", atomic.LoadUint64(&total),
-					atomic.LoadUint64(&failed))
-			default:
+				klog.InfoS("progress",
+					"total", atomic.LoadUint64(&total),
+					"failed", atomic.LoadUint64(&failed),
+					"queueDepth", len(reqCh)+len(mutCh))
+				saveState()
+			case <-stopTicker:
+				return
 			}
 		}
 	}()
 	wg.Wait()
+	close(stopTicker)
+	<-tickerDone
+	saveState()
+
+	if err := reporter.Close(); err != nil {
+		klog.Errorf("While closing diff reporter: %v", err)
+	}
+	summary.print()
 }
 
 func getReq(s string) (*api.Request, error) {
@@ -213,7 +414,7 @@ func getSchema(client *dgo.Dgraph) string {
 	return string(resp.Json)
 }
 
-func getCounts(client *dgo.Dgraph) error {
+func getCounts(ctx context.Context, client *dgo.Dgraph) error {
 	var sch Schema
 	s := getSchema(client)
 	if err := json.Unmarshal([]byte(s), &sch); err != nil {
@@ -223,7 +424,7 @@ func getCounts(client *dgo.Dgraph) error {
 	for _, s := range sch.Schema {
 		q := fmt.Sprintf("query { f(func: has(%s)) { count(uid) } }", s.Predicate)
 		req := &api.Request{Query: q}
-		r, err := runQuery(req, client)
+		r, err := runQuery(ctx, req, client)
 		if err != nil {
 			return errors.Wrap(err, "While running query")
 		}
@@ -238,32 +439,58 @@ func getCounts(client *dgo.Dgraph) error {
 	return nil
 }
 
-func runQuery(r *api.Request, client *dgo.Dgraph) (string, error) {
-	txn := client.NewReadOnlyTxn().BestEffort()
-	ctx, cancel := context.WithTimeout(context.Background(), 1800*time.Second)
-	defer cancel()
-	resp, err := txn.QueryWithVars(ctx, r.Query, r.Vars)
+func runQuery(ctx context.Context, r *api.Request, client *dgo.Dgraph) (string, error) {
+	var resp *api.Response
+	err := withRetry(ctx, opts.maxRetries, opts.retryBackoff, func() error {
+		qCtx, cancel := context.WithTimeout(ctx, opts.queryTimeout)
+		defer cancel()
+
+		txn := client.NewReadOnlyTxn().BestEffort()
+		var queryErr error
+		resp, queryErr = txn.QueryWithVars(qCtx, r.Query, r.Vars)
+		return queryErr
+	})
 	if err != nil {
-		return "", errors.Errorf("While running query %s %+v  got error %v\n",
-			r.Query, r.Vars, err)
+		return "", errors.Wrapf(err, "While running query %s %+v", r.Query, r.Vars)
 	}
 	return string(resp.Json), nil
 }
 
-func areEqualJSON(s1, s2 string) bool {
-	var o1 interface{}
-	var o2 interface{}
+// RequestResult is the side of a comparison produced by replaying one
+// api.Request: the query response JSON (if any) and any UIDs the mutation
+// (or upsert) assigned to new blank nodes.
+type RequestResult struct {
+	Json string
+	Uids map[string]string
+}
 
-	var err error
-	err = json.Unmarshal([]byte(s1), &o1)
-	if err != nil {
-		return false
+// runRequest replays a decoded log record against one cluster. Plain
+// queries go through the existing read-only path, retried on transient
+// errors; anything carrying mutations is run once as a (possibly upserted)
+// read-write transaction via dgo.Txn.Do, mirroring how the alpha itself
+// would have executed it. Mutations aren't retried here since replaying one
+// twice would double-apply it against that cluster.
+func runRequest(ctx context.Context, r *api.Request, client *dgo.Dgraph) (*RequestResult, error) {
+	if len(r.Mutations) == 0 {
+		resp, err := runQuery(ctx, r, client)
+		return &RequestResult{Json: resp}, err
 	}
-	err = json.Unmarshal([]byte(s2), &o2)
+
+	mCtx, cancel := context.WithTimeout(ctx, opts.queryTimeout)
+	defer cancel()
+
+	txn := client.NewTxn()
+	defer func() {
+		if !r.CommitNow {
+			_ = txn.Discard(mCtx)
+		}
+	}()
+
+	resp, err := txn.Do(mCtx, r)
 	if err != nil {
-		return false
+		return &RequestResult{}, errors.Wrapf(err, "While running mutation %s %+v", r.Query, r.Mutations)
 	}
-	return reflect.DeepEqual(o1, o2)
+	return &RequestResult{Json: string(resp.Json), Uids: resp.Uids}, nil
 }
 
 func check(err error) {